@@ -2,19 +2,17 @@ package main
 
 import (
 	"crypto/rand"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/rolandshoemaker/dns"
-	"golang.org/x/net/proxy"
 )
 
 func randomString() string {
@@ -26,26 +24,33 @@ func randomString() string {
 	return fmt.Sprintf("%X", b)
 }
 
-func newDialer() proxy.Dialer {
-	randStr := randomString()
-	p, err := proxy.SOCKS5(
-		"tcp",
-		"127.0.0.1:9150",
-		&proxy.Auth{User: randStr, Password: randStr},
-		&net.Dialer{Timeout: 10 * time.Second},
-	)
-	if err != nil {
-		panic(err)
-	}
-	return p
-}
-
 type basicResult struct {
 	LookupTook         time.Duration
 	HTTPConnectionTook time.Duration
 	Error              string
 	Page               string
 	IP                 string
+
+	// IPs holds every A/AAAA address resolved for the name, with TTLs.
+	// WinningFamily records which family ("4" or "6") the Happy Eyeballs
+	// connect raced to first, and DialTook how long that winning dial
+	// took, broken out of HTTPConnectionTook.
+	IPs           []ResolvedAddr `json:",omitempty"`
+	WinningFamily string         `json:",omitempty"`
+	DialTook      time.Duration  `json:",omitempty"`
+
+	// CircuitToken is only populated on the Tor path: the isolation
+	// token of the circuit used (see TorDialerPool).
+	CircuitToken string `json:",omitempty"`
+
+	// Scheme records the scheme the probe's final request used ("http" or
+	// "https"). Protocol, TLSVersion and Certificates are only populated
+	// when the probe ended up speaking HTTPS (either -scheme https or an
+	// auto-upgrade following a 301/308 redirect).
+	Scheme       string     `json:",omitempty"`
+	Protocol     string     `json:",omitempty"`
+	TLSVersion   string     `json:",omitempty"`
+	Certificates []CertInfo `json:",omitempty"`
 }
 
 type result struct {
@@ -53,57 +58,80 @@ type result struct {
 
 	Tor   *basicResult
 	Plain *basicResult
+
+	// CertMismatch is set when both paths completed a probe and the
+	// certificate chain seen over Tor differs from the one seen directly,
+	// which can indicate a MITM-ing Tor exit. A probe that ended on plain
+	// HTTP captures no chain, so it is also set when only one of the two
+	// paths ended up speaking HTTPS.
+	CertMismatch bool `json:",omitempty"`
 }
 
 type tester struct {
-	resolver  *dns.Client
-	publicDNS string
-	client    *http.Client
-	names     chan string
-	results   chan result
+	dnsAddrs           []string
+	resolvers          []Upstream
+	dnsBootstrap       string
+	scheme             string
+	insecureSkipVerify bool
+	happyEyeballsDelay time.Duration
+	torPool            *TorDialerPool
+	names              chan string
+	results            chan result
 }
 
-func (t *tester) processName(wg *sync.WaitGroup, name string, client *http.Client, resolver *dns.Client, grabPage bool) (r *basicResult) {
+func (t *tester) processName(wg *sync.WaitGroup, name string, dial func(network, addr string) (net.Conn, error), resolvers []Upstream, grabPage bool) (r *basicResult) {
 	defer wg.Done()
 	r = &basicResult{}
-	msg := new(dns.Msg)
-	msg.SetEdns0(4096, true)
-	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
 	s := time.Now()
-	resp, _, err := resolver.Exchange(msg, t.publicDNS)
+	addrs, err := resolveDualStack(resolvers, name)
 	r.LookupTook = time.Since(s)
 	if err != nil {
 		r.Error = err.Error()
 		return
 	}
-	if len(resp.Answer) == 0 {
-		r.Error = "No addresses found"
-		return
-	}
-	for _, answer := range resp.Answer {
-		if a, ok := answer.(*dns.A); ok {
-			r.IP = a.A.String()
-			break
+	r.IPs = addrs
+
+	connectDial := func(network, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
 		}
+		conn, winner, dialTook, err := happyEyeballsDial(dial, addrs, port, t.happyEyeballsDelay)
+		if err == nil {
+			r.WinningFamily = winner.Family
+			r.DialTook = dialTook
+			if r.IP == "" {
+				r.IP = winner.IP
+			}
+		}
+		return conn, err
 	}
-	if r.IP == "" {
-		r.Error = "Malformed DNS response"
-		return
-	}
+
 	s = time.Now()
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", r.IP), nil)
-	if err != nil {
-		r.Error = err.Error()
-		return
+	scheme := t.scheme
+	client := newHTTPClient(connectDial, name, t.insecureSkipVerify)
+	httpResp, err := doRequest(client, scheme, name)
+	if err == nil && scheme == "http" && (httpResp.StatusCode == http.StatusMovedPermanently || httpResp.StatusCode == http.StatusPermanentRedirect) {
+		httpResp.Body.Close()
+		scheme = "https"
+		client = newHTTPClient(connectDial, name, t.insecureSkipVerify)
+		httpResp, err = doRequest(client, scheme, name)
 	}
-	req.Host = name
-	httpResp, err := client.Do(req)
 	r.HTTPConnectionTook = time.Since(s)
 	if err != nil {
 		r.Error = err.Error()
 		return
 	}
 	defer httpResp.Body.Close()
+	r.Scheme = scheme
+	if httpResp.TLS != nil {
+		r.Protocol = httpResp.TLS.NegotiatedProtocol
+		if r.Protocol == "" {
+			r.Protocol = "http/1.1"
+		}
+		r.TLSVersion = tlsVersionName(httpResp.TLS.Version)
+		r.Certificates = certInfoFromChain(httpResp.TLS.PeerCertificates)
+	}
 	if grabPage {
 		body, err := ioutil.ReadAll(httpResp.Body)
 		if err != nil {
@@ -114,26 +142,47 @@ func (t *tester) processName(wg *sync.WaitGroup, name string, client *http.Clien
 	return
 }
 
-func (t *tester) process(name string) {
+func doRequest(client *http.Client, scheme, name string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/", scheme, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+func (t *tester) process(name string, worker int) {
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 	r := result{Name: name}
-	go func() { r.Plain = t.processName(wg, name, t.client, t.resolver, false) }()
+	go func() { r.Plain = t.processName(wg, name, nil, t.resolvers, false) }()
 
-	proxyDialer := newDialer()
-	torResolver := new(dns.Client)
-	torResolver.Net = "tcp"
-	torResolver.ReadTimeout = 10 * time.Second
-	torResolver.Dialer = proxyDialer
-	torClient := new(http.Client)
-	torClient.Timeout = 10 * time.Second
-	torClient.Transport = &http.Transport{
-		Dial:                proxyDialer.Dial,
-		TLSHandshakeTimeout: 10 * time.Second,
+	proxyDialer, circuitToken, err := t.torPool.Get(name, worker)
+	var torResolvers []Upstream
+	if err == nil {
+		torResolvers = make([]Upstream, 0, len(t.resolvers))
+		for _, addr := range t.dnsAddrs {
+			var u Upstream
+			u, err = AddressToUpstream(addr, t.dnsBootstrap, proxyDialer)
+			if err != nil {
+				break
+			}
+			torResolvers = append(torResolvers, u)
+		}
+	}
+	if err != nil {
+		wg.Done()
+		r.Tor = &basicResult{Error: err.Error(), CircuitToken: circuitToken}
+	} else {
+		go func() {
+			r.Tor = t.processName(wg, name, proxyDialer.Dial, torResolvers, true)
+			r.Tor.CircuitToken = circuitToken
+		}()
 	}
-	go func() { r.Tor = t.processName(wg, name, torClient, torResolver, true) }()
 
 	wg.Wait()
+	if r.Plain != nil && r.Tor != nil && r.Plain.Error == "" && r.Tor.Error == "" {
+		r.CertMismatch = !certChainsMatch(r.Plain.Certificates, r.Tor.Certificates)
+	}
 	if r.Tor.Error != "" {
 		fmt.Println(":(", r.Tor.Error)
 	} else {
@@ -146,62 +195,89 @@ func (t *tester) run(workers int) {
 	wg := new(sync.WaitGroup)
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func() {
+		go func(worker int) {
 			defer wg.Done()
 			for name := range t.names {
-				t.process(name)
+				t.process(name, worker)
 			}
-		}()
+		}(i)
 	}
 	wg.Wait()
 }
 
 func main() {
-	dnsAddr := flag.String("dnsAddr", "8.8.8.8:53", "")
+	dnsAddr := flag.String("dnsAddr", "8.8.8.8:53", "comma-separated list of DNS upstreams (udp://, tcp://, tls:// or https://)")
+	dnsBootstrap := flag.String("dnsBootstrap", "8.8.8.8:53", "plain do53 address used to resolve hostnames in -dnsAddr https:// URLs")
+	torSOCKS := flag.String("torSOCKS", "127.0.0.1:9150", "Tor SOCKS5 control endpoint")
+	transport := flag.String("transport", "", "pluggable transport to dial Tor through, as <name>://<bridge-line> (e.g. obfs4://...); overrides -torSOCKS")
+	isolation := flag.String("isolation", string(IsolatePerName), "circuit isolation policy: per-name, per-worker, per-N-requests or shared (ignored when -transport is set: all requests share the one tor process it launches)")
+	isolationN := flag.Int("isolationN", 10, "N for -isolation=per-N-requests")
+	scheme := flag.String("scheme", "http", "scheme to probe with: http or https (auto-upgrades to https on a 301/308)")
+	insecureSkipVerify := flag.Bool("insecureSkipVerify", false, "skip TLS certificate verification (measurement only)")
+	happyEyeballsDelay := flag.Duration("happyEyeballsDelay", 150*time.Millisecond, "stagger between Happy Eyeballs (RFC 8305) v4/v6 connection attempts")
 	namesFile := flag.String("namesFile", "names", "")
-	resultsFile := flag.String("resultsFile", "results.json", "")
+	resultsFile := flag.String("resultsFile", "results.ndjson", "NDJSON file results are streamed to, one result per line")
+	resume := flag.Bool("resume", false, "skip names already present in -resultsFile and append to it instead of starting fresh")
+	fsyncEvery := flag.Int("fsyncEvery", 100, "fsync -resultsFile every N results (0 disables periodic fsync)")
 	workers := flag.Int("workers", 1, "")
 	flag.Parse()
 
 	t := tester{
-		resolver:  new(dns.Client),
-		publicDNS: *dnsAddr,
-		client:    new(http.Client),
+		dnsAddrs:           strings.Split(*dnsAddr, ","),
+		dnsBootstrap:       *dnsBootstrap,
+		scheme:             *scheme,
+		insecureSkipVerify: *insecureSkipVerify,
+		happyEyeballsDelay: *happyEyeballsDelay,
+		torPool:            NewTorDialerPool(*torSOCKS, *transport, IsolationPolicy(*isolation), *isolationN),
 	}
-	t.resolver.Net = "tcp"
-	t.resolver.ReadTimeout = 10 * time.Second
-	t.client.Timeout = 10 * time.Second
+	defer t.torPool.Close()
 
-	// load names
-	names, err := ioutil.ReadFile(*namesFile)
-	if err != nil {
-		fmt.Println(err)
-		return
+	// A -transport run leaves a tor process (and its PT client child)
+	// running until t.torPool.Close() tears it down; make sure Ctrl-C
+	// does that instead of leaking the process tree.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		t.torPool.Close()
+		os.Exit(130)
+	}()
+
+	for _, addr := range t.dnsAddrs {
+		u, err := AddressToUpstream(addr, t.dnsBootstrap, nil)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		t.resolvers = append(t.resolvers, u)
 	}
-	splitNames := strings.Split(string(names), "\n")
-	t.names = make(chan string, len(splitNames))
-	t.results = make(chan result, len(splitNames))
-	for _, n := range splitNames {
-		t.names <- n
+
+	done := map[string]bool{}
+	if *resume {
+		var err error
+		done, err = loadProcessedNames(*resultsFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
-	close(t.names)
 
-	t.run(*workers)
+	t.names = make(chan string, *workers*4)
+	t.results = make(chan result, *workers*4)
 
-	results := []result{}
-	for r := range t.results {
-		results = append(results, r)
-	}
-	jsonResults, err := json.Marshal(results)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	err = ioutil.WriteFile(*resultsFile, jsonResults, os.ModePerm)
-	if err != nil {
+	go func() {
+		if err := feedNames(*namesFile, done, t.names); err != nil {
+			fmt.Println(err)
+		}
+		close(t.names)
+	}()
+
+	writerDone := make(chan error, 1)
+	go func() { writerDone <- resultWriter(*resultsFile, t.results, *fsyncEvery, !*resume) }()
+
+	t.run(*workers)
+	close(t.results)
+	if err := <-writerDone; err != nil {
 		fmt.Println(err)
-		return
 	}
-
-	// ???
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/rolandshoemaker/dns"
+)
+
+// ResolvedAddr is one address returned for a name, tagged with its record
+// type and TTL.
+type ResolvedAddr struct {
+	IP     string
+	TTL    uint32
+	Family string // "4" or "6"
+}
+
+// resolveDualStack issues the A and AAAA queries for name in parallel
+// against resolvers and returns every address found across both.
+func resolveDualStack(resolvers []Upstream, name string) ([]ResolvedAddr, error) {
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+
+	type outcome struct {
+		qtype uint16
+		addrs []ResolvedAddr
+		err   error
+	}
+	results := make(chan outcome, len(qtypes))
+	for _, qtype := range qtypes {
+		go func(qtype uint16) {
+			msg := new(dns.Msg)
+			msg.SetEdns0(4096, true)
+			msg.SetQuestion(dns.Fqdn(name), qtype)
+			resp, err := raceExchange(resolvers, msg)
+			if err != nil {
+				results <- outcome{qtype: qtype, err: err}
+				return
+			}
+			addrs := make([]ResolvedAddr, 0, len(resp.Answer))
+			for _, answer := range resp.Answer {
+				switch rr := answer.(type) {
+				case *dns.A:
+					addrs = append(addrs, ResolvedAddr{IP: rr.A.String(), TTL: rr.Hdr.Ttl, Family: "4"})
+				case *dns.AAAA:
+					addrs = append(addrs, ResolvedAddr{IP: rr.AAAA.String(), TTL: rr.Hdr.Ttl, Family: "6"})
+				}
+			}
+			results <- outcome{qtype: qtype, addrs: addrs}
+		}(qtype)
+	}
+
+	var all []ResolvedAddr
+	var lastErr error
+	for i := 0; i < len(qtypes); i++ {
+		o := <-results
+		if o.err != nil {
+			lastErr = o.err
+			continue
+		}
+		all = append(all, o.addrs...)
+	}
+	if len(all) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses found")
+		}
+		return nil, lastErr
+	}
+	return all, nil
+}
+
+// happyEyeballsDial races a connection attempt to every resolved address
+// (RFC 8305), preferring IPv6 and staggering each subsequent attempt by
+// stagger. Returns the first successful connection, which family won, and
+// how long that winning attempt's own Dial call took.
+func happyEyeballsDial(dial func(network, addr string) (net.Conn, error), addrs []ResolvedAddr, port string, stagger time.Duration) (net.Conn, ResolvedAddr, time.Duration, error) {
+	if dial == nil {
+		dial = net.Dial
+	}
+	if len(addrs) == 0 {
+		return nil, ResolvedAddr{}, 0, fmt.Errorf("no addresses to dial")
+	}
+	sorted := make([]ResolvedAddr, len(addrs))
+	copy(sorted, addrs)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Family == "6" && sorted[j].Family == "4" })
+
+	type outcome struct {
+		conn     net.Conn
+		addr     ResolvedAddr
+		dialTook time.Duration
+		err      error
+	}
+	results := make(chan outcome, len(sorted))
+	for i, a := range sorted {
+		go func(i int, a ResolvedAddr) {
+			if i > 0 {
+				time.Sleep(time.Duration(i) * stagger)
+			}
+			s := time.Now()
+			conn, err := dial("tcp", net.JoinHostPort(a.IP, port))
+			results <- outcome{conn: conn, addr: a, dialTook: time.Since(s), err: err}
+		}(i, a)
+	}
+	var lastErr error
+	for i := 0; i < len(sorted); i++ {
+		o := <-results
+		if o.err == nil {
+			return o.conn, o.addr, o.dialTook, nil
+		}
+		lastErr = o.err
+	}
+	return nil, ResolvedAddr{}, 0, lastErr
+}
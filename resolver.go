@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rolandshoemaker/dns"
+	"golang.org/x/net/proxy"
+)
+
+// dohGETMaxPackedLen is the largest packed message sent as a GET (RFC 8484
+// §4.1's base64url "dns" query parameter) before falling back to POST.
+const dohGETMaxPackedLen = 300
+
+// Upstream is a DNS resolver reachable over some transport: plain do53,
+// DNS-over-TLS or DNS-over-HTTPS.
+type Upstream interface {
+	Exchange(msg *dns.Msg) (*dns.Msg, error)
+}
+
+// do53Upstream exchanges queries with a classic UDP or TCP resolver.
+type do53Upstream struct {
+	client  *dns.Client
+	address string
+}
+
+func (u *do53Upstream) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.client.Exchange(msg, u.address)
+	return resp, err
+}
+
+// dotUpstream exchanges queries with a resolver over DNS-over-TLS (RFC 7858).
+type dotUpstream struct {
+	client  *dns.Client
+	address string
+}
+
+func (u *dotUpstream) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.client.Exchange(msg, u.address)
+	return resp, err
+}
+
+// dohUpstream exchanges queries with a resolver over DNS-over-HTTPS (RFC 8484).
+type dohUpstream struct {
+	client *http.Client
+	url    string
+}
+
+func (u *dohUpstream) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var req *http.Request
+	if len(packed) <= dohGETMaxPackedLen {
+		q := base64.RawURLEncoding.EncodeToString(packed)
+		req, err = http.NewRequest("GET", u.url+"?dns="+q, nil)
+	} else {
+		req, err = http.NewRequest("POST", u.url, bytes.NewReader(packed))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	httpResp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH query to %s failed: %s", u.url, httpResp.Status)
+	}
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// bootstrapDial resolves a DoH URL's hostname against the bootstrap do53
+// resolver before dialing, instead of the system resolver.
+func bootstrapDial(bootstrap string) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return net.Dial(network, addr)
+		}
+		bc := &dns.Client{Net: "udp", ReadTimeout: 10 * time.Second}
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
+		resp, _, err := bc.Exchange(msg, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		for _, answer := range resp.Answer {
+			if a, ok := answer.(*dns.A); ok {
+				return net.Dial(network, net.JoinHostPort(a.A.String(), port))
+			}
+		}
+		return nil, fmt.Errorf("bootstrap resolver %s returned no A records for %s", bootstrap, host)
+	}
+}
+
+// AddressToUpstream parses addr into an Upstream. addr may be a bare
+// "host:port" (plain UDP do53), or a URL with a "udp://", "tcp://",
+// "tls://" (DNS-over-TLS) or "https://" (DNS-over-HTTPS) scheme. dialer,
+// if non-nil, routes the underlying connection (e.g. through Tor);
+// bootstrap resolves a DoH URL's hostname when dialer is nil.
+func AddressToUpstream(addr, bootstrap string, dialer proxy.Dialer) (Upstream, error) {
+	scheme, rest := "udp", addr
+	if i := strings.Index(addr, "://"); i != -1 {
+		scheme, rest = addr[:i], addr[i+len("://"):]
+	}
+	switch scheme {
+	case "udp", "tcp":
+		c := &dns.Client{Net: scheme, ReadTimeout: 10 * time.Second}
+		if dialer != nil {
+			c.Net = "tcp"
+			c.Dialer = dialer
+		}
+		return &do53Upstream{client: c, address: rest}, nil
+	case "tls":
+		c := &dns.Client{
+			Net:         "tcp-tls",
+			TLSConfig:   &tls.Config{},
+			ReadTimeout: 10 * time.Second,
+		}
+		if dialer != nil {
+			c.Dialer = dialer
+		}
+		return &dotUpstream{client: c, address: rest}, nil
+	case "https":
+		transport := &http.Transport{TLSHandshakeTimeout: 10 * time.Second}
+		switch {
+		case dialer != nil:
+			transport.Dial = dialer.Dial
+		case bootstrap != "":
+			transport.Dial = bootstrapDial(bootstrap)
+		}
+		return &dohUpstream{
+			client: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+			url:    addr,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported resolver scheme %q", scheme)
+	}
+}
+
+// raceExchange sends msg to every upstream concurrently and returns the
+// first successful response.
+func raceExchange(upstreams []Upstream, msg *dns.Msg) (*dns.Msg, error) {
+	type outcome struct {
+		resp *dns.Msg
+		err  error
+	}
+	results := make(chan outcome, len(upstreams))
+	for _, u := range upstreams {
+		go func(u Upstream) {
+			resp, err := u.Exchange(msg)
+			results <- outcome{resp, err}
+		}(u)
+	}
+	var lastErr error
+	for i := 0; i < len(upstreams); i++ {
+		o := <-results
+		if o.err == nil && o.resp != nil {
+			return o.resp, nil
+		}
+		if o.err != nil {
+			lastErr = o.err
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream returned a response")
+	}
+	return nil, lastErr
+}
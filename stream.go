@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// resultWriter streams NDJSON results to path as they arrive on in,
+// fsyncing every syncEvery results (0 disables periodic fsync). truncate
+// controls whether path is truncated first (a fresh run) or appended to
+// (-resume).
+func resultWriter(path string, in <-chan result, syncEvery int, truncate bool) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	n := 0
+	for r := range in {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		n++
+		if syncEvery > 0 && n%syncEvery == 0 {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return f.Sync()
+}
+
+// loadProcessedNames reads an existing NDJSON results file and returns the
+// set of names -resume can skip. Decodes with json.Decoder rather than
+// bufio.Scanner, since a captured page can push a line past a scanner's
+// fixed buffer limit.
+func loadProcessedNames(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	done := map[string]bool{}
+	dec := json.NewDecoder(f)
+	for {
+		var r result
+		if err := dec.Decode(&r); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return done, err
+		}
+		done[r.Name] = true
+	}
+	return done, nil
+}
+
+// feedNames reads path line by line, sending each non-empty name not in
+// skip to out. It does not close out; the caller does that once it returns.
+func feedNames(path string, skip map[string]bool, out chan<- string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		name := scanner.Text()
+		if name == "" || skip[name] {
+			continue
+		}
+		out <- name
+	}
+	return scanner.Err()
+}
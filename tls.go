@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// CertInfo is a compact summary of a certificate captured during an HTTPS
+// probe, suitable for JSON output and for comparing the chain seen over
+// Tor against the chain seen on the direct path.
+type CertInfo struct {
+	Subject    string
+	Issuer     string
+	SPKISHA256 string
+	NotBefore  time.Time
+	NotAfter   time.Time
+	DNSNames   []string
+}
+
+func certInfoFromChain(chain []*x509.Certificate) []CertInfo {
+	infos := make([]CertInfo, 0, len(chain))
+	for _, cert := range chain {
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		infos = append(infos, CertInfo{
+			Subject:    cert.Subject.String(),
+			Issuer:     cert.Issuer.String(),
+			SPKISHA256: fmt.Sprintf("%x", spki),
+			NotBefore:  cert.NotBefore,
+			NotAfter:   cert.NotAfter,
+			DNSNames:   cert.DNSNames,
+		})
+	}
+	return infos
+}
+
+// certChainsMatch reports whether two chains, as captured by
+// certInfoFromChain, present the same SPKI hashes in the same order. A
+// mismatch between the Tor-seen and plain-seen chain for the same name is
+// a strong indicator of a MITM-ing Tor exit.
+func certChainsMatch(a, b []CertInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].SPKISHA256 != b[i].SPKISHA256 {
+			return false
+		}
+	}
+	return true
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+// newHTTPClient builds an http.Client for a single probe. serverName sets
+// the TLS SNI/ServerName, and dial, if non-nil, routes the underlying
+// connection through e.g. a Tor SOCKS5 dialer. CheckRedirect stops at the
+// first redirect rather than following it, so callers can inspect and act
+// on its status code themselves (e.g. an http->https auto-upgrade).
+func newHTTPClient(dial func(network, addr string) (net.Conn, error), serverName string, insecureSkipVerify bool) *http.Client {
+	transport := &http.Transport{
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: insecureSkipVerify,
+		},
+	}
+	if dial != nil {
+		transport.Dial = dial
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
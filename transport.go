@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// PTDialerFactory constructs a proxy.Dialer for a pluggable transport
+// given its bridge line, as passed via -transport in the form
+// "<name>://<bridge-line>". The returned cleanup func kills the tor/PT
+// process tree it launched and removes its scratch directory; callers
+// must call it once they're done with the dialer.
+type PTDialerFactory func(bridgeLine string) (dialer proxy.Dialer, cleanup func(), err error)
+
+// ptBinaries maps a pluggable transport name to the client binary that
+// implements it, following the naming used by Tor Browser bundles.
+var ptBinaries = map[string]string{
+	"obfs4":     "obfs4proxy",
+	"meek":      "meek-client",
+	"snowflake": "snowflake-client",
+}
+
+// ptRegistry is the set of registered pluggable transport dialer
+// factories, keyed by transport name.
+var ptRegistry = map[string]PTDialerFactory{}
+
+func init() {
+	for name, binary := range ptBinaries {
+		name, binary := name, binary
+		ptRegistry[name] = func(bridgeLine string) (proxy.Dialer, func(), error) {
+			return dialPTBinary(name, binary, bridgeLine)
+		}
+	}
+}
+
+// TransportDialer parses a -transport value of the form
+// "<name>://<bridge-line>" and returns a proxy.Dialer routing through
+// whichever pluggable transport client is registered for name. See
+// PTDialerFactory for the returned cleanup func.
+func TransportDialer(spec string) (proxy.Dialer, func(), error) {
+	i := strings.Index(spec, "://")
+	if i == -1 {
+		return nil, nil, fmt.Errorf("malformed -transport %q, expected <name>://<bridge-line>", spec)
+	}
+	name, bridgeLine := spec[:i], spec[i+len("://"):]
+	factory, ok := ptRegistry[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported pluggable transport %q", name)
+	}
+	return factory(bridgeLine)
+}
+
+// torBootstrapTimeout bounds how long dialPTBinary waits for the tor
+// process it launches to report a 100% bootstrap before giving up.
+const torBootstrapTimeout = 60 * time.Second
+
+// dialPTBinary launches a real `tor` process configured to reach bridgeLine
+// through the named pluggable transport client, and returns a dialer
+// against that tor process's own SOCKS port plus a cleanup func that kills
+// the tor (and, as its child, PT client) process and removes its scratch
+// DataDirectory.
+//
+// A PT client's local SOCKS listener (discovered via its CMETHOD line) only
+// tunnels a single connection to the configured bridge itself — it is not a
+// general-purpose outbound proxy, so it can't be dialed directly against
+// arbitrary target addresses. Building an actual Tor circuit over the
+// transport means handing the PT binary to tor via ClientTransportPlugin
+// and letting tor drive it, then dialing websites through tor's SOCKSPort
+// the same way the plain -torSOCKS path does. This also means every
+// -transport dialer is backed by one tor process, so TorDialerPool.Get
+// collapses all isolation tokens to a single shared circuit under
+// -transport rather than one circuit per token.
+func dialPTBinary(name, binary, bridgeLine string) (proxy.Dialer, func(), error) {
+	torBinary, err := exec.LookPath("tor")
+	if err != nil {
+		return nil, nil, fmt.Errorf("pluggable transport %q requires a tor binary on PATH: %w", name, err)
+	}
+	ptPath, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pluggable transport %q requires %s on PATH: %w", name, binary, err)
+	}
+
+	dataDir, err := ioutil.TempDir("", "tor-va-tests-tor-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dataDir) }
+
+	socksAddr, err := freeLocalAddr()
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	torrc := fmt.Sprintf(
+		"DataDirectory %s\nSOCKSPort %s\nUseBridges 1\nClientTransportPlugin %s exec %s\nBridge %s %s\nLog notice stdout\n",
+		dataDir, socksAddr, name, ptPath, name, bridgeLine,
+	)
+	torrcPath := dataDir + "/torrc"
+	if err := ioutil.WriteFile(torrcPath, []byte(torrc), 0600); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(torBinary, "-f", torrcPath)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	cleanup = func() {
+		cmd.Process.Kill()
+		os.RemoveAll(dataDir)
+	}
+	go cmd.Wait()
+
+	if err := waitForBootstrap(stdout, torBootstrapTimeout); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", socksAddr, nil, &net.Dialer{Timeout: 10 * time.Second})
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return dialer, cleanup, nil
+}
+
+// freeLocalAddr finds a currently-unused 127.0.0.1 port for tor's
+// SOCKSPort, by briefly binding to port 0 and releasing it.
+func freeLocalAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// waitForBootstrap scans a tor process's stdout for its "Bootstrapped 100%"
+// log line, giving up after timeout if tor never finishes bootstrapping
+// (e.g. the bridge or pluggable transport is unreachable).
+func waitForBootstrap(r io.Reader, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			if strings.Contains(scanner.Text(), "Bootstrapped 100%") {
+				done <- nil
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			done <- err
+			return
+		}
+		done <- fmt.Errorf("tor exited before bootstrapping completed")
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s waiting for tor to bootstrap", timeout)
+	}
+}